@@ -0,0 +1,130 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command huproxy-client dials a huproxy server over WebSocket and wires
+// the connection to stdin/stdout, for use as an OpenSSH ProxyCommand.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+
+	huproxy "github.com/zwcway/huproxy/lib"
+)
+
+var (
+	url              = flag.String("url", "", "huproxy URL to dial, e.g. wss://host:8086/proxy/prod-db.")
+	handshakeTimeout = flag.Duration("handshake_timeout", 10*time.Second, "Handshake timeout.")
+	writeTimeout     = flag.Duration("write_timeout", 10*time.Second, "Write timeout.")
+	jwtToken         = flag.String("jwt", "", "JWT to present in the Authorization header.")
+	jwtCmd           = flag.String("jwt_cmd", "", "Command whose stdout is used as the JWT, run instead of -jwt.")
+	pingPeriod       = flag.Duration("ping_period", 54*time.Second, "How often to ping the server on an idle connection.")
+	pongWait         = flag.Duration("pong_wait", 60*time.Second, "How long to wait for a pong before considering the connection dead.")
+)
+
+// token returns the bearer token to send, preferring -jwt_cmd when set.
+func token() (string, error) {
+	if *jwtCmd != "" {
+		out, err := exec.Command("sh", "-c", *jwtCmd).Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	return *jwtToken, nil
+}
+
+func main() {
+	flag.Parse()
+	if *url == "" {
+		log.Fatal("-url is required")
+	}
+
+	tok, err := token()
+	if err != nil {
+		log.Fatalf("Getting JWT: %v", err)
+	}
+
+	header := http.Header{}
+	if tok != "" {
+		header.Set("Authorization", "Bearer "+tok)
+	}
+
+	dialer := &websocket.Dialer{HandshakeTimeout: *handshakeTimeout}
+	conn, resp, err := dialer.Dial(*url, header)
+	if err != nil {
+		if resp != nil {
+			log.Fatalf("Dial %q: %v (status %s)", *url, err, resp.Status)
+		}
+		log.Fatalf("Dial %q: %v", *url, err)
+	}
+	defer conn.Close()
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	cancel := func() {
+		ctxCancel()
+		conn.Close()
+	}
+	defer cancel()
+
+	huproxy.Keepalive(ctx, cancel, conn, *pingPeriod, *pongWait, *writeTimeout, nil)
+
+	// stdin -> websocket
+	go func() {
+		defer cancel()
+		buf := make([]byte, 1024)
+		for ctx.Err() == nil {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				log.Debugf("Reading from stdin: %v", err)
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				log.Warningf("Writing to websocket: %v", err)
+				return
+			}
+		}
+	}()
+
+	for {
+		mt, r, err := conn.NextReader()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				log.Warningf("nextreader: %v", err)
+			}
+			return
+		}
+		if mt != websocket.BinaryMessage {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if _, err := buf.ReadFrom(r); err != nil {
+			log.Warningf("Reading from websocket: %v", err)
+			return
+		}
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			log.Warningf("Writing to stdout: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/ssh"
+)
+
+// tunnelClaims is the JWT payload a client presents on the WebSocket
+// upgrade request. Names lists the mapping entries the bearer is allowed
+// to dial; a client with no matching name for the requested target is
+// rejected before a backend connection is ever attempted.
+type tunnelClaims struct {
+	Names []string `json:"names"`
+	jwt.RegisteredClaims
+}
+
+// allows reports whether the claims authorize reaching the given mapping
+// name. "*" grants access to every name.
+func (c *tunnelClaims) allows(name string) bool {
+	for _, n := range c.Names {
+		if n == "*" || n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAuthorizedKeys parses an OpenSSH authorized_keys file into the list
+// of public keys allowed to sign client JWTs.
+func loadAuthorizedKeys(path string) ([]ssh.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading authorized_keys %q: %w", path, err)
+	}
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(b)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parsing authorized_keys %q: %w", path, err)
+		}
+		keys = append(keys, key)
+		b = rest
+	}
+	return keys, nil
+}
+
+// keyfunc returns a jwt.Keyfunc that accepts a token signed by any of the
+// given authorized keys, restricted to the asymmetric algorithms we trust
+// an SSH public key to validate. It hands ParseWithClaims the whole set so
+// every key gets a chance, not just the first one that happens to convert.
+func keyfunc(keys []ssh.PublicKey) jwt.Keyfunc {
+	return func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA, *jwt.SigningMethodEd25519:
+		default:
+			return nil, fmt.Errorf("unsupported signing method %q", t.Method.Alg())
+		}
+
+		var set jwt.VerificationKeySet
+		for _, key := range keys {
+			ck, ok := key.(ssh.CryptoPublicKey)
+			if !ok {
+				continue
+			}
+			set.Keys = append(set.Keys, jwt.VerificationKey{Key: ck.CryptoPublicKey()})
+		}
+		if len(set.Keys) == 0 {
+			return nil, fmt.Errorf("no usable authorized keys")
+		}
+		return set, nil
+	}
+}
+
+// authenticate verifies the bearer JWT on r against authorizedKeys and
+// returns its claims. The caller is responsible for checking the claims
+// authorize the requested target.
+func authenticate(r *http.Request, authorizedKeys []ssh.PublicKey) (*tunnelClaims, error) {
+	h := r.Header.Get("Authorization")
+	tok := strings.TrimPrefix(h, "Bearer ")
+	if tok == "" || tok == h {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+
+	claims := &tunnelClaims{}
+	if _, err := jwt.ParseWithClaims(tok, claims, keyfunc(authorizedKeys)); err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	return claims, nil
+}
@@ -18,14 +18,15 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 
 	huproxy "github.com/zwcway/huproxy/lib"
 )
@@ -38,46 +39,107 @@ var (
 	url              = flag.String("url", "proxy", "Path to listen to.")
 	logFile          = flag.String("log", "stdout", "log to.")
 	logLevel         = flag.String("level", "info", "log level.")
+	authorizedKeysF  = flag.String("authorized_keys", "", "Path to an SSH authorized_keys file listing keys allowed to sign client JWTs. Required.")
+	mappingFile      = flag.String("mapping", "", "Path to a YAML file mapping logical names to dial targets. Required.")
+	pingPeriod       = flag.Duration("ping_period", 54*time.Second, "How often to ping idle websocket connections.")
+	pongWait         = flag.Duration("pong_wait", 60*time.Second, "How long to wait for a pong before considering a connection dead.")
 
 	upgrader websocket.Upgrader
+
+	authorizedKeys []ssh.PublicKey
+	mapping        map[string]huproxy.DialerConfig
 )
 
 func handleProxy(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	host := r.Header.Get("Connect")
-	port := ""
-	if host == "" {
-		vars := mux.Vars(r)
-		host = vars["host"]
-		port = vars["port"]
-	} else {
-		host, port, _ = net.SplitHostPort(host)
-	}
-	if host == "" || port == "" {
-		log.Warningf("Missing host or port")
+	name := mux.Vars(r)["name"]
+	if name == "" {
+		log.Warningf("Missing target name")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	claims, err := authenticate(r, authorizedKeys)
+	if err != nil {
+		log.Warningf("Rejecting %q: %v", r.RemoteAddr, err)
+		// name isn't validated yet at this point, so don't let an
+		// unauthenticated client mint arbitrary target label values.
+		connectionsTotal.WithLabelValues(unknownTarget, "unauthorized").Inc()
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	target, ok := mapping[name]
+	if !ok {
+		log.Warningf("Unknown target %q requested by %q", name, r.RemoteAddr)
+		// Same here: name is by definition not a known mapping key.
+		connectionsTotal.WithLabelValues(unknownTarget, "not_found").Inc()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !claims.allows(name) {
+		log.Warningf("%q denied access to %q", r.RemoteAddr, name)
+		connectionsTotal.WithLabelValues(name, "forbidden").Inc()
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	dialer, err := huproxy.NewDialer(target)
+	if err != nil {
+		log.Errorf("Mapping %q has invalid dialer config: %v", name, err)
+		connectionsTotal.WithLabelValues(name, "config_error").Inc()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	handshakeStart := time.Now()
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Warningf("Failed to upgrade to websockets: %v", err)
+		connectionsTotal.WithLabelValues(name, "upgrade_error").Inc()
 		w.WriteHeader(http.StatusBadGateway)
 		return
 	}
 	defer conn.Close()
+	handshakeDuration.Observe(time.Since(handshakeStart).Seconds())
 
-	s, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), *dialTimeout)
+	dialStart := time.Now()
+	backend, err := dialer.DialTimeout(*dialTimeout)
+	dialDuration.Observe(time.Since(dialStart).Seconds())
 	if err != nil {
-		log.Warningf("Failed to connect to %q:%q: %v", host, port, err)
+		log.Warningf("Failed to connect to %q (%q): %v", name, target.Target, err)
+		connectionsTotal.WithLabelValues(name, "dial_error").Inc()
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
+	s := &countingConn{Conn: backend, target: name}
 	defer s.Close()
 
+	connectionsTotal.WithLabelValues(name, "ok").Inc()
+	activeConnections.WithLabelValues(name).Inc()
+	defer activeConnections.WithLabelValues(name).Dec()
+
+	defer registerConn(conn, s)()
+
+	// From here on, cancel also tears down both ends of the tunnel, so a
+	// failed ping or a fired read deadline kills the backend connection
+	// instead of leaving it half-open.
+	ctxCancel := cancel
+	cancel = func() {
+		ctxCancel()
+		conn.Close()
+		s.Close()
+	}
+
+	connStart := time.Now()
 	log.Infof("incoming connection from %q to %q", conn.RemoteAddr(), s.RemoteAddr())
+
+	huproxy.Keepalive(ctx, cancel, conn, *pingPeriod, *pongWait, *writeTimeout, func(d time.Duration) {
+		wsPingRTT.Observe(d.Seconds())
+	})
+
 	// websocket -> server
 	go func() {
 		defer func() {
@@ -97,6 +159,7 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 			}
 			if err != nil {
 				log.Errorf("nextreader: %v", err)
+				cancel()
 				return
 			}
 			if mt != websocket.BinaryMessage {
@@ -112,6 +175,7 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 
 	// server -> websocket
 	// TODO: NextWriter() seems to be broken.
+	closeReason := "eof"
 	if err := huproxy.File2WS(ctx, cancel, s, conn); err == io.EOF {
 		if err := conn.WriteControl(websocket.CloseMessage,
 			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
@@ -121,8 +185,17 @@ func handleProxy(w http.ResponseWriter, r *http.Request) {
 		}
 	} else if err != nil {
 		log.Warningf("Reading from file: %v", err)
+		closeReason = err.Error()
 	}
 	log.Debugf("finished connection from %q to %q", conn.RemoteAddr(), s.RemoteAddr())
+
+	log.WithFields(log.Fields{
+		"target":       name,
+		"bytes_in":     atomic.LoadInt64(&s.rx),
+		"bytes_out":    atomic.LoadInt64(&s.tx),
+		"duration_sec": time.Since(connStart).Seconds(),
+		"close_reason": closeReason,
+	}).Info("connection closed")
 }
 
 func setLogger() func() {
@@ -164,6 +237,17 @@ func main() {
 	flag.Parse()
 	defer setLogger()()
 
+	if *authorizedKeysF == "" || *mappingFile == "" {
+		log.Fatal("-authorized_keys and -mapping are required")
+	}
+	var err error
+	if authorizedKeys, err = loadAuthorizedKeys(*authorizedKeysF); err != nil {
+		log.Fatal(err)
+	}
+	if mapping, err = loadMapping(*mappingFile); err != nil {
+		log.Fatal(err)
+	}
+
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:   1024,
 		WriteBufferSize:  1024,
@@ -173,10 +257,12 @@ func main() {
 		},
 	}
 
+	serveMetrics()
+
 	log.Infof("huproxy %s", huproxy.Version)
 	m := mux.NewRouter()
-	m.HandleFunc(fmt.Sprintf("/%s/{host}/{port}", *url), handleProxy)
-	m.HandleFunc(fmt.Sprintf("/%s", *url), handleProxy)
+	m.HandleFunc(fmt.Sprintf("/%s/{name}", *url), handleProxy)
+	m.HandleFunc("/healthz", healthzHandler)
 	s := &http.Server{
 		Addr:           *listen,
 		Handler:        m,
@@ -184,5 +270,17 @@ func main() {
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	log.Fatal(s.ListenAndServe())
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Block here, not in ListenAndServe, so the process doesn't exit out
+	// from under awaitShutdown: ListenAndServe returns as soon as
+	// srv.Shutdown closes the listener, well before the drain below (which
+	// waits on hijacked WebSocket connections Shutdown doesn't track) is
+	// done.
+	awaitShutdown(s)
 }
@@ -0,0 +1,44 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	huproxy "github.com/zwcway/huproxy/lib"
+)
+
+// loadMapping reads a YAML file mapping logical names to dial targets, e.g.:
+//
+//	prod-db: 10.0.0.5:5432
+//	web:     127.0.0.1:8080
+//	docker:
+//	  dialer: unix
+//	  target: /var/run/docker.sock
+//
+// See huproxy.DialerConfig for the full set of per-target fields.
+func loadMapping(path string) (map[string]huproxy.DialerConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading mapping file %q: %w", path, err)
+	}
+	m := map[string]huproxy.DialerConfig{}
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parsing mapping file %q: %w", path, err)
+	}
+	return m, nil
+}
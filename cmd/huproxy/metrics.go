@@ -0,0 +1,106 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// unknownTarget is the target label used for connections_total increments
+// that happen before the requested name is known to be a valid mapping
+// key (e.g. failed auth, unknown name), so an unauthenticated client can't
+// blow up label cardinality by requesting arbitrary path segments.
+const unknownTarget = "unknown"
+
+var (
+	metricsListen = flag.String("metrics_listen", "", "Address to serve Prometheus metrics on. Disabled if empty.")
+
+	connectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "huproxy_connections_total",
+		Help: "Total proxy connections, by target and result.",
+	}, []string{"target", "result"})
+
+	activeConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "huproxy_active_connections",
+		Help: "Currently open proxy connections, by target.",
+	}, []string{"target"})
+
+	bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "huproxy_bytes_total",
+		Help: "Bytes proxied, by direction (rx = client to target, tx = target to client) and target.",
+	}, []string{"direction", "target"})
+
+	dialDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "huproxy_dial_duration_seconds",
+		Help: "Time spent dialing the backend target.",
+	})
+
+	handshakeDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "huproxy_handshake_duration_seconds",
+		Help: "Time spent completing the WebSocket upgrade handshake.",
+	})
+
+	wsPingRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "huproxy_ws_ping_rtt_seconds",
+		Help: "Round-trip time of keepalive pings.",
+	})
+)
+
+// serveMetrics starts the Prometheus /metrics endpoint if -metrics_listen
+// is set. It does not block.
+func serveMetrics() {
+	if *metricsListen == "" {
+		return
+	}
+	m := http.NewServeMux()
+	m.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Fatal(http.ListenAndServe(*metricsListen, m))
+	}()
+}
+
+// countingConn tallies bytes flowing through a backend connection, both
+// into the huproxy_bytes_total metric and locally so the per-connection
+// close log line can report bytes_in/bytes_out.
+type countingConn struct {
+	net.Conn
+	target string
+	rx, tx int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&c.tx, int64(n))
+		bytesTotal.WithLabelValues("tx", c.target).Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&c.rx, int64(n))
+		bytesTotal.WithLabelValues("rx", c.target).Add(float64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,113 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	shutdownGrace = flag.Duration("shutdown_grace", 30*time.Second, "How long to wait for in-flight connections to drain before force-closing them on shutdown.")
+
+	draining  int32 // 1 once a shutdown signal has been received; read/written atomically.
+	liveConns sync.Map
+)
+
+// registerConn tracks conn (and the backend s it is tunneling to) so a
+// graceful shutdown can push it a close frame and, failing that, force it
+// closed. The returned func removes the entry and must be deferred by the
+// caller.
+func registerConn(conn *websocket.Conn, s io.Closer) func() {
+	liveConns.Store(conn, s)
+	return func() { liveConns.Delete(conn) }
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+func liveConnCount() int {
+	n := 0
+	liveConns.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining\n"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// awaitShutdown blocks until SIGINT or SIGTERM, then depools the server: it
+// marks /healthz unhealthy and pushes every live connection a CloseGoingAway
+// frame. srv.Shutdown stops the listener, but it neither tracks nor waits
+// for our hijacked WebSocket connections, so the actual drain wait is driven
+// here by polling liveConns; anything still open after -shutdown_grace is
+// force-closed.
+func awaitShutdown(srv *http.Server) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	log.Infof("Shutdown signal received, draining for up to %s", *shutdownGrace)
+	atomic.StoreInt32(&draining, 1)
+
+	liveConns.Range(func(k, _ interface{}) bool {
+		conn := k.(*websocket.Conn)
+		deadline := time.Now().Add(*writeTimeout)
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		if err := conn.WriteControl(websocket.CloseMessage, msg, deadline); err != nil {
+			log.Warningf("Sending shutdown close frame to %q: %v", conn.RemoteAddr(), err)
+		}
+		return true
+	})
+
+	go srv.Shutdown(context.Background())
+
+	deadline := time.Now().Add(*shutdownGrace)
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for liveConnCount() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+
+	if n := liveConnCount(); n > 0 {
+		log.Warningf("Grace period expired with %d connection(s) still open, forcing close", n)
+		liveConns.Range(func(k, v interface{}) bool {
+			k.(*websocket.Conn).Close()
+			v.(io.Closer).Close()
+			return true
+		})
+	}
+	log.Info("Shutdown complete")
+}
@@ -0,0 +1,219 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package huproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+	"gopkg.in/yaml.v3"
+)
+
+// Dialer reaches a single backend target. Implementations are built from a
+// DialerConfig entry in the mapping file.
+type Dialer interface {
+	DialTimeout(timeout time.Duration) (net.Conn, error)
+}
+
+// DialerConfig describes how to reach a mapping target. It unmarshals from
+// either a bare YAML string, e.g.:
+//
+//	prod-db: 10.0.0.5:5432
+//
+// which is shorthand for {dialer: tcp, target: "10.0.0.5:5432"}, or a full
+// mapping, e.g.:
+//
+//	docker:
+//	  dialer: unix
+//	  target: /var/run/docker.sock
+//	metrics:
+//	  dialer: tls
+//	  target: example.com:443
+//	  server_name: example.com
+//	internal-api:
+//	  dialer: socks5
+//	  target: 10.1.2.3:443
+//	  proxy: 127.0.0.1:1080
+type DialerConfig struct {
+	Type       string `yaml:"dialer"`
+	Target     string `yaml:"target"`
+	ServerName string `yaml:"server_name,omitempty"`
+	CertFile   string `yaml:"cert,omitempty"`
+	KeyFile    string `yaml:"key,omitempty"`
+	CAFile     string `yaml:"ca,omitempty"`
+	ProxyAddr  string `yaml:"proxy,omitempty"`
+}
+
+// UnmarshalYAML implements the shorthand "name: host:port" form on top of
+// the full struct form.
+func (c *DialerConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		c.Type = "tcp"
+		return value.Decode(&c.Target)
+	}
+
+	type plain DialerConfig // avoid infinite recursion into UnmarshalYAML
+	var p plain
+	if err := value.Decode(&p); err != nil {
+		return err
+	}
+	*c = DialerConfig(p)
+	if c.Type == "" {
+		c.Type = "tcp"
+	}
+	return nil
+}
+
+// NewDialer builds the Dialer described by c.
+func NewDialer(c DialerConfig) (Dialer, error) {
+	switch c.Type {
+	case "", "tcp":
+		return &tcpDialer{addr: c.Target}, nil
+	case "unix":
+		return &unixDialer{path: c.Target}, nil
+	case "tls":
+		return newTLSDialer(c)
+	case "socks5":
+		return newSocks5Dialer(c)
+	case "http-connect":
+		return newHTTPConnectDialer(c)
+	default:
+		return nil, fmt.Errorf("unknown dialer %q", c.Type)
+	}
+}
+
+type tcpDialer struct{ addr string }
+
+func (d *tcpDialer) DialTimeout(timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", d.addr, timeout)
+}
+
+type unixDialer struct{ path string }
+
+func (d *unixDialer) DialTimeout(timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", d.path, timeout)
+}
+
+type tlsDialer struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func newTLSDialer(c DialerConfig) (*tlsDialer, error) {
+	cfg := &tls.Config{ServerName: c.ServerName}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client cert: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file %q: %w", c.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	return &tlsDialer{addr: c.Target, tlsConfig: cfg}, nil
+}
+
+func (d *tlsDialer) DialTimeout(timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", d.addr, d.tlsConfig)
+}
+
+type socks5Dialer struct {
+	addr      string
+	proxyAddr string
+}
+
+func newSocks5Dialer(c DialerConfig) (*socks5Dialer, error) {
+	if c.ProxyAddr == "" {
+		return nil, fmt.Errorf("socks5 dialer requires \"proxy\"")
+	}
+	return &socks5Dialer{addr: c.Target, proxyAddr: c.ProxyAddr}, nil
+}
+
+func (d *socks5Dialer) DialTimeout(timeout time.Duration) (net.Conn, error) {
+	upstream, err := proxy.SOCKS5("tcp", d.proxyAddr, nil, &net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("building socks5 dialer: %w", err)
+	}
+	return upstream.Dial("tcp", d.addr)
+}
+
+type httpConnectDialer struct {
+	addr      string
+	proxyAddr string
+}
+
+func newHTTPConnectDialer(c DialerConfig) (*httpConnectDialer, error) {
+	if c.ProxyAddr == "" {
+		return nil, fmt.Errorf("http-connect dialer requires \"proxy\"")
+	}
+	return &httpConnectDialer{addr: c.Target, proxyAddr: c.ProxyAddr}, nil
+}
+
+func (d *httpConnectDialer) DialTimeout(timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", d.proxyAddr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("dialing upstream proxy %q: %w", d.proxyAddr, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", d.addr, d.addr)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading CONNECT response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy refused CONNECT %s: %s", d.addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	// br may have buffered bytes of the backend's own traffic past the
+	// CONNECT response (e.g. an SSH banner) in the same read syscall;
+	// serve those before falling through to conn.
+	return &bufConn{Conn: conn, r: br}, nil
+}
+
+// bufConn replays bytes buffered in r (read ahead while parsing a protocol
+// response on the same connection) before reading further from the
+// underlying net.Conn.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,92 @@
+// Copyright 2017-2021 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package huproxy contains code shared between the huproxy server and
+// client binaries.
+package huproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Version is the huproxy release, reported in the server's startup log.
+const Version = "0.8"
+
+// Keepalive arms conn with a read deadline of pongWait, renewed on every
+// pong, and starts a goroutine that pings conn every pingPeriod until ctx
+// is done. It calls cancel, tearing down the tunnel, if a ping fails; a
+// fired read deadline surfaces as an error from the caller's next read on
+// conn, and the caller's read loop tears the tunnel down then. Both the
+// server and the client binary call this right after the WebSocket
+// handshake so dead NAT sessions and half-open backends don't linger forever.
+//
+// onRTT, if non-nil, is called with the round-trip time of every
+// answered ping.
+func Keepalive(ctx context.Context, cancel func(), conn *websocket.Conn, pingPeriod, pongWait, writeWait time.Duration, onRTT func(time.Duration)) {
+	var lastPing int64 // unix nanoseconds, accessed atomically
+
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		if onRTT != nil {
+			if sent := atomic.LoadInt64(&lastPing); sent != 0 {
+				onRTT(time.Since(time.Unix(0, sent)))
+			}
+		}
+		return nil
+	})
+
+	go func() {
+		ticker := time.NewTicker(pingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				atomic.StoreInt64(&lastPing, time.Now().UnixNano())
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+}
+
+// File2WS copies s to conn until s is closed or ctx is cancelled,
+// cancelling ctx itself if the copy fails.
+func File2WS(ctx context.Context, cancel func(), s net.Conn, conn *websocket.Conn) error {
+	buf := make([]byte, 1024)
+	for ctx.Err() == nil {
+		n, err := s.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				cancel()
+			}
+			return err
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+			cancel()
+			return err
+		}
+	}
+	return io.EOF
+}